@@ -30,6 +30,12 @@ import (
 
 	"go.uber.org/zap"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 )
@@ -52,43 +58,203 @@ const (
 	loggerRateLimit     = time.Minute
 )
 
-// TODO:
-// - Add Otel tracer
-// - Collection metrics
+// instrumentationName is used as the OTel tracer/meter name for this package.
+const instrumentationName = "github.com/elastic/opentelemetry-collector-components/internal/agentcfg"
+
 type ElasticsearchFetcher struct {
-	last             time.Time
-	client           *elasticsearch.Client
-	logger           *zap.Logger
-	cache            []AgentConfig
-	cacheDuration    time.Duration
-	searchSize       int
-	mu               sync.RWMutex
-	invalidESCfg     atomic.Bool
-	cacheInitialized atomic.Bool
+	// last is the time of the most recent successful refresh. It's written
+	// by reconcile under f.mu, since it's read by the cacheAge observable
+	// gauge callback on the metrics SDK's own collection goroutine.
+	last              time.Time
+	client            *elasticsearch.Client
+	logger            *zap.Logger
+	cache             []AgentConfig
+	cacheDuration     time.Duration
+	searchSize        int
+	keepAlive         time.Duration
+	fullSweepInterval time.Duration
+	indexName         string
+	mu                sync.RWMutex
+	invalidESCfg      atomic.Bool
+	cacheInitialized  atomic.Bool
+	pitUnsupported    atomic.Bool
+
+	// docs and lastSeqNo track the incremental cache state: one entry per
+	// known document, plus the highest _seq_no observed so far, so the next
+	// tick can ask Elasticsearch for only what changed.
+	//
+	// _seq_no is assigned per shard, not index-wide, so a single lastSeqNo
+	// watermark is only correct against a single-shard index: watching one
+	// shard's sequence can't tell you whether a write landed on another
+	// shard. This holds for the default ElasticsearchIndexName, which is
+	// single-shard, but WithIndexName lets a caller point this fetcher at an
+	// index with more shards, where incremental refresh would silently miss
+	// updates. See reconcile in elasticsearch_incremental.go.
+	docs      map[string]cachedDoc
+	lastSeqNo int64
+	lastFull  time.Time
+
+	subsMu      sync.RWMutex
+	subscribers []*subscriber
+
+	tracerProvider  trace.TracerProvider
+	meterProvider   metric.MeterProvider
+	tracer          trace.Tracer
+	metrics         *fetcherMetrics
+	instrumentation *esInstrumentation
+	fallback        Fetcher
+}
+
+// Option configures an ElasticsearchFetcher.
+type Option func(*ElasticsearchFetcher)
+
+// WithTracerProvider sets the trace.TracerProvider used to instrument
+// cache refreshes. A no-op provider is used if this option is omitted.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(f *ElasticsearchFetcher) {
+		f.tracerProvider = tp
+	}
+}
+
+// WithMeterProvider sets the metric.MeterProvider used to record fetcher
+// metrics. A no-op provider is used if this option is omitted.
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(f *ElasticsearchFetcher) {
+		f.meterProvider = mp
+	}
+}
+
+// WithSearchSize sets the page size used when paginating through the
+// agent config index, via either point-in-time search or, as a fallback,
+// scroll. It defaults to 100.
+func WithSearchSize(n int) Option {
+	return func(f *ElasticsearchFetcher) {
+		f.searchSize = n
+	}
+}
+
+// WithKeepAlive sets how long Elasticsearch should keep the point-in-time
+// used to paginate a single cache refresh alive for. It defaults to the
+// fetcher's cache duration. The scroll fallback doesn't use it: scroll
+// contexts are always kept alive for the cache duration.
+func WithKeepAlive(d time.Duration) Option {
+	return func(f *ElasticsearchFetcher) {
+		f.keepAlive = d
+	}
+}
+
+// WithFallbackFetcher sets a Fetcher to delegate to while the local cache
+// isn't initialized yet, or once Elasticsearch has reported an invalid
+// config (e.g. missing index privileges). Without a fallback, Fetch returns
+// ErrInfrastructureNotReady / ErrNoValidElasticsearchConfig while the cache
+// isn't initialized, and keeps serving an initialized cache even after
+// Elasticsearch has reported an invalid config.
+func WithFallbackFetcher(fallback Fetcher) Option {
+	return func(f *ElasticsearchFetcher) {
+		f.fallback = fallback
+	}
+}
+
+// WithIndexName overrides the Elasticsearch index the fetcher reads agent
+// config from. It defaults to ElasticsearchIndexName; multi-tenant
+// deployments fronting several clusters may need per-tenant overrides.
+func WithIndexName(name string) Option {
+	return func(f *ElasticsearchFetcher) {
+		f.indexName = name
+	}
+}
+
+// WithFullSweepInterval sets how often refreshCache performs a full sweep of
+// the agent config index instead of an incremental, _seq_no-filtered
+// refresh. Full sweeps are the only way deletions are detected, since a
+// filtered search can't tell us a document is gone. Defaults to 10x the
+// cache duration.
+func WithFullSweepInterval(d time.Duration) Option {
+	return func(f *ElasticsearchFetcher) {
+		f.fullSweepInterval = d
+	}
 }
 
 func NewElasticsearchFetcher(
 	client *elasticsearch.Client,
 	cacheDuration time.Duration,
 	logger *zap.Logger,
+	opts ...Option,
 ) *ElasticsearchFetcher {
-	return &ElasticsearchFetcher{
-		client:        client,
-		cacheDuration: cacheDuration,
-		searchSize:    100,
-		logger:        logger,
+	f := &ElasticsearchFetcher{
+		client:            client,
+		cacheDuration:     cacheDuration,
+		searchSize:        100,
+		keepAlive:         cacheDuration,
+		fullSweepInterval: 10 * cacheDuration,
+		indexName:         ElasticsearchIndexName,
+		logger:            logger,
+		tracerProvider:    trace.NewNoopTracerProvider(),
+		meterProvider:     noop.NewMeterProvider(),
+		docs:              make(map[string]cachedDoc),
+	}
+	for _, opt := range opts {
+		opt(f)
 	}
+
+	f.tracer = f.tracerProvider.Tracer(instrumentationName)
+	metrics, err := newFetcherMetrics(f.meterProvider.Meter(instrumentationName), f)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed to create agentcfg fetcher metrics: %s", err))
+		metrics, _ = newFetcherMetrics(noop.NewMeterProvider().Meter(instrumentationName), f)
+	}
+	f.metrics = metrics
+	f.instrumentation = newESInstrumentation(f.tracer)
+
+	return f
+}
+
+// CacheSize returns the number of agent config documents currently held in
+// the cache.
+func (f *ElasticsearchFetcher) CacheSize() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.cache)
+}
+
+// Instrumentation returns an elastictransport.Instrumentation implementation
+// that should be passed to elasticsearch.Config.Instrumentation when
+// constructing the *elasticsearch.Client used by this fetcher, so that
+// individual ES HTTP round trips are traced as children of the refresh span.
+func (f *ElasticsearchFetcher) Instrumentation() *esInstrumentation {
+	return f.instrumentation
 }
 
 // Fetch finds a matching agent config based on the received query.
 func (f *ElasticsearchFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
-	if f.cacheInitialized.Load() {
-		// Happy path: serve fetch requests using an initialized cache.
+	start := time.Now()
+	result, err := f.fetch(ctx, query)
+
+	attrs := metric.WithAttributes(attribute.Bool("found", err == nil && result.Source.Etag != ""))
+	f.metrics.fetchLatency.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err != nil {
+		f.metrics.fetchMisses.Add(ctx, 1)
+	} else {
+		f.metrics.fetchHits.Add(ctx, 1)
+	}
+	return result, err
+}
+
+func (f *ElasticsearchFetcher) fetch(ctx context.Context, query Query) (Result, error) {
+	if f.cacheInitialized.Load() && (!f.invalidESCfg.Load() || f.fallback == nil) {
+		// Serve fetch requests from the cache whenever it's initialized and
+		// either Elasticsearch config is healthy, or there's no fallback to
+		// prefer instead: a transient 401/403 on a background refresh
+		// shouldn't throw away an already-populated, still-usable cache.
 		f.mu.RLock()
 		defer f.mu.RUnlock()
 		return matchAgentConfig(query, f.cache), nil
 	}
 
+	if f.fallback != nil {
+		return f.fallback.Fetch(ctx, query)
+	}
+
 	if f.invalidESCfg.Load() {
 		return Result{}, errors.New(ErrNoValidElasticsearchConfig)
 	}
@@ -139,46 +305,149 @@ func (f *ElasticsearchFetcher) Run(ctx context.Context) error {
 	}
 }
 
+type cacheHit struct {
+	ID          string `json:"_id"`
+	SeqNo       int64  `json:"_seq_no"`
+	PrimaryTerm int64  `json:"_primary_term"`
+	Source      struct {
+		Settings map[string]string `json:"settings"`
+		Service  struct {
+			Name        string `json:"name"`
+			Environment string `json:"environment"`
+		} `json:"service"`
+		AgentName string `json:"agent_name"`
+		ETag      string `json:"etag"`
+	} `json:"_source"`
+	Sort []json.RawMessage `json:"sort"`
+}
+
 type cacheResult struct {
 	ScrollID string `json:"_scroll_id"`
+	PitID    string `json:"pit_id"`
 	Hits     struct {
-		Hits []struct {
-			Source struct {
-				Settings map[string]string `json:"settings"`
-				Service  struct {
-					Name        string `json:"name"`
-					Environment string `json:"environment"`
-				} `json:"service"`
-				AgentName string `json:"agent_name"`
-				ETag      string `json:"etag"`
-			} `json:"_source"`
-		} `json:"hits"`
+		Hits []cacheHit `json:"hits"`
 	} `json:"hits"`
 }
 
+// cachedDocFromHit converts a raw cacheResult hit into the incremental
+// cache's bookkeeping representation.
+func cachedDocFromHit(hit cacheHit) cachedDoc {
+	return cachedDoc{
+		id:          hit.ID,
+		seqNo:       hit.SeqNo,
+		primaryTerm: hit.PrimaryTerm,
+		config: AgentConfig{
+			ServiceName:        hit.Source.Service.Name,
+			ServiceEnvironment: hit.Source.Service.Environment,
+			AgentName:          hit.Source.AgentName,
+			Etag:               hit.Source.ETag,
+			Config:             hit.Source.Settings,
+		},
+	}
+}
+
 func (f *ElasticsearchFetcher) refreshCache(ctx context.Context) (err error) {
-	scrollID := ""
-	buffer := make([]AgentConfig, 0, len(f.cache))
+	ctx, span := f.tracer.Start(ctx, "agentcfg.refresh_cache", trace.WithAttributes(
+		attribute.String("db.elasticsearch.index", f.indexName),
+	))
+	start := time.Now()
+	defer func() {
+		f.metrics.refreshDuration.Record(ctx, time.Since(start).Seconds())
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			f.recordRefreshFailure(ctx, err)
+		}
+		span.End()
+	}()
 
 	// The refresh cache operation should complete within refreshCacheTimeout.
 	ctx, cancel := context.WithTimeout(ctx, refreshCacheTimeout)
 	defer cancel()
 
+	full := !f.cacheInitialized.Load() ||
+		f.fullSweepInterval <= 0 ||
+		f.lastFull.IsZero() ||
+		time.Since(f.lastFull) >= f.fullSweepInterval
+
+	var docs []cachedDoc
+	var pages int
+	usedScroll := false
+
+	switch {
+	case full:
+		if !f.pitUnsupported.Load() {
+			docs, pages, err = f.refreshCachePIT(ctx)
+			if errors.Is(err, errPITUnsupported) {
+				f.logger.Warn("elasticsearch cluster does not support point-in-time search, falling back to scroll")
+				f.pitUnsupported.Store(true)
+				err = nil
+			}
+		}
+		if f.pitUnsupported.Load() && docs == nil && err == nil {
+			usedScroll = true
+			docs, pages, err = f.refreshCacheScroll(ctx)
+		}
+	case f.pitUnsupported.Load():
+		// Incremental refresh depends on point-in-time search to take a
+		// consistent, _seq_no-filtered snapshot. Without it there's no way
+		// to page incrementally, so treat this as a full sweep via scroll
+		// instead of calling refreshCacheIncremental, which would just
+		// fail every tick with errPITUnsupported.
+		usedScroll = true
+		full = true
+		docs, pages, err = f.refreshCacheScroll(ctx)
+	default:
+		docs, pages, err = f.refreshCacheIncremental(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	events := f.reconcile(docs, full)
+	f.cacheInitialized.Store(true)
+	if full {
+		f.mu.RLock()
+		f.lastFull = f.last
+		f.mu.RUnlock()
+	}
+	f.fanOut(ctx, events)
+
+	f.mu.RLock()
+	cacheSize := len(f.cache)
+	f.mu.RUnlock()
+
+	span.SetAttributes(
+		attribute.Int("agentcfg.hit_count", len(docs)),
+		attribute.Int("agentcfg.scroll_pages", pages),
+		attribute.Bool("agentcfg.full_sweep", full),
+		attribute.Bool("agentcfg.used_scroll_fallback", usedScroll),
+	)
+	f.metrics.hitsPerRefresh.Record(ctx, int64(len(docs)))
+	f.metrics.scrollPages.Add(ctx, int64(pages))
+	f.metrics.cacheSize.Record(ctx, int64(cacheSize))
+	return nil
+}
+
+// refreshCacheScroll is the legacy pagination strategy, kept as a fallback
+// for Elasticsearch clusters that don't support point-in-time search (e.g.
+// versions older than 7.10, or restrictive licenses). It always performs a
+// full sweep: scroll doesn't support filtering by _seq_no cheaply.
+func (f *ElasticsearchFetcher) refreshCacheScroll(ctx context.Context) ([]cachedDoc, int, error) {
+	scrollID := ""
+	buffer := make([]cachedDoc, 0, len(f.cache))
+
+	pages := 0
 	for {
-		result, err := f.singlePageRefresh(ctx, scrollID)
+		result, err := f.singlePageRefreshScroll(ctx, scrollID)
 		if err != nil {
 			f.clearScroll(ctx, scrollID)
-			return err
+			return nil, 0, err
 		}
+		pages++
 
 		for _, hit := range result.Hits.Hits {
-			buffer = append(buffer, AgentConfig{
-				ServiceName:        hit.Source.Service.Name,
-				ServiceEnvironment: hit.Source.Service.Environment,
-				AgentName:          hit.Source.AgentName,
-				Etag:               hit.Source.ETag,
-				Config:             hit.Source.Settings,
-			})
+			buffer = append(buffer, cachedDocFromHit(hit))
 		}
 		scrollID = result.ScrollID
 		if len(result.Hits.Hits) == 0 {
@@ -187,32 +456,66 @@ func (f *ElasticsearchFetcher) refreshCache(ctx context.Context) (err error) {
 	}
 
 	f.clearScroll(ctx, scrollID)
+	return buffer, pages, nil
+}
 
-	f.mu.Lock()
-	f.cache = buffer
-	f.mu.Unlock()
-	f.cacheInitialized.Store(true)
-	f.last = time.Now()
-	return nil
+// recordRefreshFailure increments the refresh failure counter, split by
+// whether the error originated from a 4xx/5xx Elasticsearch response or a
+// transport-level failure (e.g. connection reset, timeout).
+func (f *ElasticsearchFetcher) recordRefreshFailure(ctx context.Context, err error) {
+	var statusErr *elasticsearchStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode >= 400 && statusErr.StatusCode < 500:
+			f.metrics.refreshFailures4xx.Add(ctx, 1)
+		case statusErr.StatusCode >= 500:
+			f.metrics.refreshFailures5xx.Add(ctx, 1)
+		}
+		return
+	}
+	f.metrics.refreshFailuresTransport.Add(ctx, 1)
+}
+
+// elasticsearchStatusError wraps a non-2xx Elasticsearch response so callers
+// can distinguish it from transport-level failures.
+type elasticsearchStatusError struct {
+	StatusCode int
+}
+
+func (e *elasticsearchStatusError) Error() string {
+	return fmt.Sprintf("refresh cache elasticsearch returned status %d", e.StatusCode)
 }
 
 func (f *ElasticsearchFetcher) clearScroll(ctx context.Context, scrollID string) {
+	if scrollID == "" {
+		return
+	}
+
+	ctx, span := f.tracer.Start(ctx, "agentcfg.clear_scroll")
+	defer span.End()
+
 	resp, err := esapi.ClearScrollRequest{
 		ScrollID: []string{scrollID},
 	}.Do(ctx, f.client)
 	if err != nil {
+		span.RecordError(err)
 		f.logger.Warn(fmt.Sprintf("failed to clear scroll: %v", err))
 		return
 	}
+	defer resp.Body.Close()
 
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 	if resp.IsError() {
 		f.logger.Warn(fmt.Sprintf("clearscroll request returned error: %s", resp.Status()))
 	}
-
-	resp.Body.Close()
 }
 
-func (f *ElasticsearchFetcher) singlePageRefresh(ctx context.Context, scrollID string) (cacheResult, error) {
+func (f *ElasticsearchFetcher) singlePageRefreshScroll(ctx context.Context, scrollID string) (cacheResult, error) {
+	ctx, span := f.tracer.Start(ctx, "agentcfg.single_page_refresh_scroll", trace.WithAttributes(
+		attribute.Bool("agentcfg.has_scroll_id", scrollID != ""),
+	))
+	defer span.End()
+
 	var result cacheResult
 	var err error
 	var resp *esapi.Response
@@ -220,9 +523,10 @@ func (f *ElasticsearchFetcher) singlePageRefresh(ctx context.Context, scrollID s
 	switch scrollID {
 	case "":
 		resp, err = esapi.SearchRequest{
-			Index:  []string{ElasticsearchIndexName},
-			Size:   &f.searchSize,
-			Scroll: f.cacheDuration,
+			Index:            []string{f.indexName},
+			Size:             &f.searchSize,
+			Scroll:           f.cacheDuration,
+			SeqNoPrimaryTerm: &seqNoPrimaryTerm,
 		}.Do(ctx, f.client)
 	default:
 		resp, err = esapi.ScrollRequest{
@@ -231,10 +535,14 @@ func (f *ElasticsearchFetcher) singlePageRefresh(ctx context.Context, scrollID s
 		}.Do(ctx, f.client)
 	}
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return result, err
 	}
 	defer resp.Body.Close()
 
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
 	if resp.StatusCode >= http.StatusBadRequest {
 		// Elasticsearch returns 401 on unauthorized requests and 403 on insufficient permission
 		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
@@ -244,7 +552,13 @@ func (f *ElasticsearchFetcher) singlePageRefresh(ctx context.Context, scrollID s
 		if err == nil {
 			f.logger.Debug(fmt.Sprintf("refresh cache elasticsearch returned status %d: %s", resp.StatusCode, string(bodyBytes)))
 		}
-		return result, fmt.Errorf("refresh cache elasticsearch returned status %d", resp.StatusCode)
+		statusErr := &elasticsearchStatusError{StatusCode: resp.StatusCode}
+		span.RecordError(statusErr)
+		span.SetStatus(codes.Error, statusErr.Error())
+		return result, statusErr
 	}
-	return result, json.NewDecoder(resp.Body).Decode(&result)
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	span.SetAttributes(attribute.Int("agentcfg.hit_count", len(result.Hits.Hits)))
+	return result, err
 }
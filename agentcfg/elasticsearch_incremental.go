@@ -0,0 +1,315 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// subscriberBufferSize bounds how many undelivered events a single
+// subscriber can accumulate before older ones are dropped.
+const subscriberBufferSize = 64
+
+// cachedDoc is the incremental cache's bookkeeping unit: an AgentConfig plus
+// the Elasticsearch document identity needed to detect updates (_seq_no
+// advancing) and, on a full sweep, deletions (the id disappearing).
+type cachedDoc struct {
+	id          string
+	seqNo       int64
+	primaryTerm int64
+	config      AgentConfig
+}
+
+// ConfigChangeEventType identifies what happened to an agent config.
+type ConfigChangeEventType int
+
+const (
+	ConfigChangeAdd ConfigChangeEventType = iota
+	ConfigChangeUpdate
+	ConfigChangeRemove
+)
+
+// ConfigChangeEvent describes a single agent config addition, update, or
+// removal detected by a cache refresh. Old is the zero value for adds, New
+// is the zero value for removals.
+type ConfigChangeEvent struct {
+	Type ConfigChangeEventType
+	Old  AgentConfig
+	New  AgentConfig
+}
+
+type subscriber struct {
+	ch chan ConfigChangeEvent
+}
+
+// send delivers ev to the subscriber without blocking, dropping the oldest
+// buffered event to make room if the channel is full. It reports whether ev
+// was ultimately enqueued.
+func (s *subscriber) send(ev ConfigChangeEvent) bool {
+	select {
+	case s.ch <- ev:
+		return true
+	default:
+	}
+
+	select {
+	case <-s.ch:
+	default:
+	}
+
+	select {
+	case s.ch <- ev:
+		return true
+	default:
+		return false
+	}
+}
+
+// Subscribe returns a channel of ConfigChangeEvents describing agent config
+// additions, updates, and removals as they're detected by cache refreshes,
+// so callers don't have to wait for the next Fetch to see new config. The
+// channel is closed once ctx is done; callers should keep draining it
+// promptly, since a slow consumer only has subscriberBufferSize events of
+// slack before older ones are dropped (see eventsDropped metric).
+func (f *ElasticsearchFetcher) Subscribe(ctx context.Context) <-chan ConfigChangeEvent {
+	sub := &subscriber{ch: make(chan ConfigChangeEvent, subscriberBufferSize)}
+
+	f.subsMu.Lock()
+	f.subscribers = append(f.subscribers, sub)
+	f.subsMu.Unlock()
+	f.metrics.subscriberCount.Add(ctx, 1)
+
+	go func() {
+		<-ctx.Done()
+		f.unsubscribe(sub)
+	}()
+
+	return sub.ch
+}
+
+func (f *ElasticsearchFetcher) unsubscribe(sub *subscriber) {
+	f.subsMu.Lock()
+	defer f.subsMu.Unlock()
+
+	for i, s := range f.subscribers {
+		if s == sub {
+			f.subscribers = append(f.subscribers[:i], f.subscribers[i+1:]...)
+			close(sub.ch)
+			f.metrics.subscriberCount.Add(context.Background(), -1)
+			return
+		}
+	}
+}
+
+func (f *ElasticsearchFetcher) fanOut(ctx context.Context, events []ConfigChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	f.subsMu.RLock()
+	subs := make([]*subscriber, len(f.subscribers))
+	copy(subs, f.subscribers)
+	f.subsMu.RUnlock()
+
+	for _, sub := range subs {
+		for _, ev := range events {
+			// A full buffered channel means send will discard its oldest
+			// event to make room, which counts as a drop too.
+			displacing := cap(sub.ch) > 0 && len(sub.ch) == cap(sub.ch)
+			if sub.send(ev) {
+				f.metrics.eventsEmitted.Add(ctx, 1)
+				if displacing {
+					f.metrics.eventsDropped.Add(ctx, 1)
+				}
+			} else {
+				f.metrics.eventsDropped.Add(ctx, 1)
+			}
+		}
+	}
+}
+
+// reconcile merges freshly fetched documents into f.docs, rebuilds f.cache
+// from the result, and returns the add/update/remove events the merge
+// produced. On a full sweep, any previously known document not present in
+// fetched is treated as deleted. Incremental (non-full) refreshes never
+// produce remove events, since a _seq_no-filtered search can't distinguish
+// "unchanged" from "deleted".
+func (f *ElasticsearchFetcher) reconcile(fetched []cachedDoc, full bool) []ConfigChangeEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var events []ConfigChangeEvent
+	seen := make(map[string]struct{}, len(fetched))
+
+	for _, doc := range fetched {
+		seen[doc.id] = struct{}{}
+
+		old, existed := f.docs[doc.id]
+		switch {
+		case !existed:
+			events = append(events, ConfigChangeEvent{Type: ConfigChangeAdd, New: doc.config})
+		case old.seqNo != doc.seqNo || old.primaryTerm != doc.primaryTerm:
+			events = append(events, ConfigChangeEvent{Type: ConfigChangeUpdate, Old: old.config, New: doc.config})
+		}
+		f.docs[doc.id] = doc
+
+		// doc.seqNo is per shard, so this watermark is only a valid
+		// cross-refresh cursor against a single-shard index (see the
+		// comment on lastSeqNo in elasticsearch.go).
+		if doc.seqNo > f.lastSeqNo {
+			f.lastSeqNo = doc.seqNo
+		}
+	}
+
+	if full {
+		for id, old := range f.docs {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			events = append(events, ConfigChangeEvent{Type: ConfigChangeRemove, Old: old.config})
+			delete(f.docs, id)
+		}
+	}
+
+	cache := make([]AgentConfig, 0, len(f.docs))
+	for _, doc := range f.docs {
+		cache = append(cache, doc.config)
+	}
+	f.cache = cache
+	f.last = time.Now()
+
+	return events
+}
+
+// incrementalSearchBody is the request body for a PIT search filtered to
+// documents that changed since the last observed _seq_no.
+type incrementalSearchBody struct {
+	Size        int               `json:"size"`
+	PIT         pitQuery          `json:"pit"`
+	Sort        []json.RawMessage `json:"sort"`
+	SearchAfter []json.RawMessage `json:"search_after,omitempty"`
+	Query       incrementalQuery  `json:"query"`
+}
+
+type incrementalQuery struct {
+	Range incrementalRange `json:"range"`
+}
+
+type incrementalRange struct {
+	SeqNo incrementalSeqNoRange `json:"_seq_no"`
+}
+
+type incrementalSeqNoRange struct {
+	GT int64 `json:"gt"`
+}
+
+var seqNoSort = []json.RawMessage{json.RawMessage(`{"_seq_no":"asc"}`)}
+
+// refreshCacheIncremental opens a short-lived point-in-time and pages
+// through only the documents whose _seq_no advanced past the last full or
+// incremental refresh, via seq_no_primary_term + search_after on _seq_no.
+func (f *ElasticsearchFetcher) refreshCacheIncremental(ctx context.Context) ([]cachedDoc, int, error) {
+	pitID, err := f.openPIT(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.closePIT(ctx, pitID)
+
+	buffer := make([]cachedDoc, 0)
+	var searchAfter []json.RawMessage
+
+	pages := 0
+	for {
+		result, err := f.singlePageRefreshIncremental(ctx, pitID, f.lastSeqNo, searchAfter)
+		if err != nil {
+			return nil, 0, err
+		}
+		pages++
+
+		if result.PitID != "" {
+			pitID = result.PitID
+		}
+		for _, hit := range result.Hits.Hits {
+			buffer = append(buffer, cachedDocFromHit(hit))
+		}
+		if len(result.Hits.Hits) == 0 {
+			break
+		}
+		searchAfter = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
+	}
+
+	return buffer, pages, nil
+}
+
+func (f *ElasticsearchFetcher) singlePageRefreshIncremental(ctx context.Context, pitID string, sinceSeqNo int64, searchAfter []json.RawMessage) (cacheResult, error) {
+	ctx, span := f.tracer.Start(ctx, "agentcfg.single_page_refresh_incremental", trace.WithAttributes(
+		attribute.Int64("agentcfg.since_seq_no", sinceSeqNo),
+	))
+	defer span.End()
+
+	var result cacheResult
+
+	payload, err := json.Marshal(incrementalSearchBody{
+		Size:        f.searchSize,
+		PIT:         pitQuery{ID: pitID, KeepAlive: formatESDuration(f.keepAlive)},
+		Sort:        seqNoSort,
+		SearchAfter: searchAfter,
+		Query:       incrementalQuery{Range: incrementalRange{SeqNo: incrementalSeqNoRange{GT: sinceSeqNo}}},
+	})
+	if err != nil {
+		span.RecordError(err)
+		return result, err
+	}
+
+	resp, err := esapi.SearchRequest{
+		Body:             bytes.NewReader(payload),
+		SeqNoPrimaryTerm: &seqNoPrimaryTerm,
+	}.Do(ctx, f.client)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			f.invalidESCfg.Store(true)
+		}
+		statusErr := &elasticsearchStatusError{StatusCode: resp.StatusCode}
+		span.RecordError(statusErr)
+		span.SetStatus(codes.Error, statusErr.Error())
+		return result, statusErr
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	span.SetAttributes(attribute.Int("agentcfg.hit_count", len(result.Hits.Hits)))
+	return result, err
+}
@@ -0,0 +1,181 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"testing"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func newTestFetcher(t *testing.T) *ElasticsearchFetcher {
+	t.Helper()
+	f, _ := newTestFetcherWithReader(t)
+	return f
+}
+
+func newTestFetcherWithReader(t *testing.T) (*ElasticsearchFetcher, *sdkmetric.ManualReader) {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	f := &ElasticsearchFetcher{docs: make(map[string]cachedDoc)}
+	metrics, err := newFetcherMetrics(mp.Meter(instrumentationName), f)
+	if err != nil {
+		t.Fatalf("newFetcherMetrics: %v", err)
+	}
+	f.metrics = metrics
+	return f, reader
+}
+
+func sumCounter(t *testing.T, rm *metricdata.ResourceMetrics, name string) int64 {
+	t.Helper()
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok {
+				for _, dp := range sum.DataPoints {
+					total += dp.Value
+				}
+			}
+		}
+	}
+	return total
+}
+
+func TestReconcileAdd(t *testing.T) {
+	f := newTestFetcher(t)
+
+	events := f.reconcile([]cachedDoc{
+		{id: "1", seqNo: 1, primaryTerm: 1, config: AgentConfig{AgentName: "a"}},
+	}, true)
+
+	if len(events) != 1 || events[0].Type != ConfigChangeAdd {
+		t.Fatalf("expected a single add event, got %+v", events)
+	}
+}
+
+// TestReconcileUpdate proves that a document whose _seq_no advances between
+// two refreshes produces a ConfigChangeUpdate, which requires seq_no and
+// primary_term to actually be populated on cachedDoc (see
+// elasticsearch_pit.go's seqNoPrimaryTerm).
+func TestReconcileUpdate(t *testing.T) {
+	f := newTestFetcher(t)
+
+	f.reconcile([]cachedDoc{
+		{id: "1", seqNo: 1, primaryTerm: 1, config: AgentConfig{AgentName: "a"}},
+	}, true)
+
+	events := f.reconcile([]cachedDoc{
+		{id: "1", seqNo: 2, primaryTerm: 1, config: AgentConfig{AgentName: "b"}},
+	}, false)
+
+	if len(events) != 1 {
+		t.Fatalf("expected a single event, got %+v", events)
+	}
+	if events[0].Type != ConfigChangeUpdate {
+		t.Fatalf("expected ConfigChangeUpdate, got %v", events[0].Type)
+	}
+	if events[0].Old.AgentName != "a" || events[0].New.AgentName != "b" {
+		t.Errorf("unexpected event payload: %+v", events[0])
+	}
+	if f.lastSeqNo != 2 {
+		t.Errorf("lastSeqNo = %d, want 2", f.lastSeqNo)
+	}
+}
+
+func TestReconcileNoChangeWhenSeqNoUnchanged(t *testing.T) {
+	f := newTestFetcher(t)
+
+	doc := cachedDoc{id: "1", seqNo: 1, primaryTerm: 1, config: AgentConfig{AgentName: "a"}}
+	f.reconcile([]cachedDoc{doc}, true)
+	events := f.reconcile([]cachedDoc{doc}, false)
+
+	if len(events) != 0 {
+		t.Fatalf("expected no events when _seq_no is unchanged, got %+v", events)
+	}
+}
+
+func TestReconcileRemoveOnlyOnFullSweep(t *testing.T) {
+	f := newTestFetcher(t)
+
+	f.reconcile([]cachedDoc{
+		{id: "1", seqNo: 1, primaryTerm: 1, config: AgentConfig{AgentName: "a"}},
+	}, true)
+
+	// An incremental refresh that doesn't see id "1" must not treat it as
+	// removed: a _seq_no-filtered search can't distinguish "deleted" from
+	// "unchanged, so not returned".
+	events := f.reconcile(nil, false)
+	if len(events) != 0 {
+		t.Fatalf("expected no remove events from an incremental refresh, got %+v", events)
+	}
+
+	events = f.reconcile(nil, true)
+	if len(events) != 1 || events[0].Type != ConfigChangeRemove {
+		t.Fatalf("expected a single remove event from a full sweep, got %+v", events)
+	}
+}
+
+func TestSubscriberSendDropsOldestWhenFull(t *testing.T) {
+	sub := &subscriber{ch: make(chan ConfigChangeEvent, 2)}
+
+	for i := 0; i < 2; i++ {
+		if !sub.send(ConfigChangeEvent{Type: ConfigChangeAdd}) {
+			t.Fatalf("send %d should have succeeded into an empty slot", i)
+		}
+	}
+
+	// The buffer is now full; this send must drop the oldest event rather
+	// than the new one.
+	if !sub.send(ConfigChangeEvent{Type: ConfigChangeRemove}) {
+		t.Fatal("send into a full buffer should drop the oldest event and still enqueue")
+	}
+
+	<-sub.ch // the second original event, which survived the displacement
+	last := <-sub.ch
+	if last.Type != ConfigChangeRemove {
+		t.Errorf("expected the most recent event to survive, got %v", last.Type)
+	}
+}
+
+func TestFanOutCountsDeliveredAndDropped(t *testing.T) {
+	f, reader := newTestFetcherWithReader(t)
+
+	full := &subscriber{ch: make(chan ConfigChangeEvent)} // unbuffered, always full
+	f.subscribers = []*subscriber{full}
+
+	f.fanOut(context.Background(), []ConfigChangeEvent{{Type: ConfigChangeAdd}})
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if got := sumCounter(t, &rm, "agentcfg.elasticsearch.subscriber.events_dropped"); got != 1 {
+		t.Errorf("events_dropped = %d, want 1", got)
+	}
+	if got := sumCounter(t, &rm, "agentcfg.elasticsearch.subscriber.events_emitted"); got != 0 {
+		t.Errorf("events_emitted = %d, want 0", got)
+	}
+}
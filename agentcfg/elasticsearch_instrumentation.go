@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/elastic/elastic-transport-go/v8/elastictransport"
+)
+
+// esInstrumentation implements elastictransport.Instrumentation, emitting a
+// span per HTTP round trip performed by the Elasticsearch client. When the
+// call originates from refreshCache, the span is a child of the active
+// refresh span, so a single trace shows the cache refresh end-to-end down to
+// the underlying ES requests.
+type esInstrumentation struct {
+	tracer trace.Tracer
+}
+
+var _ elastictransport.Instrumentation = (*esInstrumentation)(nil)
+
+func newESInstrumentation(tracer trace.Tracer) *esInstrumentation {
+	return &esInstrumentation{tracer: tracer}
+}
+
+// Start begins a span for an outgoing Elasticsearch HTTP request.
+func (i *esInstrumentation) Start(ctx context.Context, name string) context.Context {
+	ctx, _ = i.tracer.Start(ctx, "elasticsearch."+name, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx
+}
+
+// Close ends the span started by Start.
+func (i *esInstrumentation) Close(ctx context.Context) {
+	span := trace.SpanFromContext(ctx)
+	if span.IsRecording() {
+		span.End()
+	}
+}
+
+// RecordError marks the current span as failed with err.
+func (i *esInstrumentation) RecordError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	if span.IsRecording() {
+		span.SetStatus(codes.Error, err.Error())
+		span.RecordError(err)
+	}
+}
+
+// RecordPathPart sets one attribute per path variable in the request URL,
+// e.g. the index name in "/{index}/_search".
+func (i *esInstrumentation) RecordPathPart(ctx context.Context, pathPart, value string) {
+	span := trace.SpanFromContext(ctx)
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("db.elasticsearch.path_parts."+pathPart, value))
+	}
+}
+
+// RecordRequestBody is a no-op: refreshCache's request bodies are paging
+// bookkeeping (PIT ids, search_after values), not useful span data, and the
+// caller already annotates refresh spans with the attributes that matter.
+func (i *esInstrumentation) RecordRequestBody(ctx context.Context, endpoint string, query io.Reader) io.ReadCloser {
+	return nil
+}
+
+// BeforeRequest is a no-op: there's nothing to enrich before the transport
+// has attached the request to a span-aware context.
+func (i *esInstrumentation) BeforeRequest(req *http.Request, endpoint string) {}
+
+// AfterRequest annotates the current span with the outgoing request's
+// method, URL path, and the Elasticsearch endpoint it's calling.
+func (i *esInstrumentation) AfterRequest(req *http.Request, system, endpoint string) {
+	span := trace.SpanFromContext(req.Context())
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("db.system", system),
+			attribute.String("db.operation", endpoint),
+			attribute.String("http.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		)
+	}
+}
+
+// AfterResponse records the outcome of the HTTP round trip on the current
+// span.
+func (i *esInstrumentation) AfterResponse(ctx context.Context, res *http.Response) {
+	span := trace.SpanFromContext(ctx)
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int("http.status_code", res.StatusCode))
+		if res.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, res.Status)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newRecordingTracer(t *testing.T) (trace.Tracer, *tracetest.SpanRecorder) {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := trace.NewTracerProvider(trace.WithSpanProcessor(sr))
+	t.Cleanup(func() { _ = tp.Shutdown(context.Background()) })
+	return tp.Tracer("test"), sr
+}
+
+func TestESInstrumentationSuccess(t *testing.T) {
+	tracer, sr := newRecordingTracer(t)
+	inst := newESInstrumentation(tracer)
+
+	ctx := inst.Start(context.Background(), "search")
+	req := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/.apm-agent-configuration/_search"}}
+	req = req.WithContext(ctx)
+	inst.AfterRequest(req, "elasticsearch", "search")
+	inst.AfterResponse(ctx, &http.Response{StatusCode: http.StatusOK})
+	inst.Close(ctx)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 ended span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "elasticsearch.search" {
+		t.Errorf("unexpected span name: %s", span.Name())
+	}
+	if span.Status().Code == codes.Error {
+		t.Errorf("expected non-error status, got %v", span.Status())
+	}
+
+	attrs := span.Attributes()
+	want := map[string]string{
+		"db.system":    "elasticsearch",
+		"db.operation": "search",
+		"http.method":  http.MethodPost,
+		"url.path":     "/.apm-agent-configuration/_search",
+	}
+	for _, kv := range attrs {
+		if exp, ok := want[string(kv.Key)]; ok && kv.Value.AsString() != exp {
+			t.Errorf("attribute %s = %q, want %q", kv.Key, kv.Value.AsString(), exp)
+		}
+	}
+}
+
+func TestESInstrumentationErrorResponse(t *testing.T) {
+	tracer, sr := newRecordingTracer(t)
+	inst := newESInstrumentation(tracer)
+
+	ctx := inst.Start(context.Background(), "search")
+	inst.AfterResponse(ctx, &http.Response{StatusCode: http.StatusForbidden, Status: "403 Forbidden"})
+	inst.Close(ctx)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 ended span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("expected error status for a 403 response, got %v", spans[0].Status())
+	}
+}
+
+func TestESInstrumentationRecordError(t *testing.T) {
+	tracer, sr := newRecordingTracer(t)
+	inst := newESInstrumentation(tracer)
+
+	ctx := inst.Start(context.Background(), "open_pit")
+	inst.RecordError(ctx, errors.New("connection reset"))
+	inst.Close(ctx)
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 ended span, got %d", len(spans))
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("expected error status, got %v", spans[0].Status())
+	}
+	if len(spans[0].Events()) == 0 {
+		t.Error("expected RecordError to attach an exception event")
+	}
+}
+
+func TestESInstrumentationRecordPathPart(t *testing.T) {
+	tracer, sr := newRecordingTracer(t)
+	inst := newESInstrumentation(tracer)
+
+	ctx := inst.Start(context.Background(), "search")
+	inst.RecordPathPart(ctx, "index", ElasticsearchIndexName)
+	inst.Close(ctx)
+
+	spans := sr.Ended()
+	found := false
+	for _, kv := range spans[0].Attributes() {
+		if string(kv.Key) == "db.elasticsearch.path_parts.index" && kv.Value.AsString() == ElasticsearchIndexName {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected db.elasticsearch.path_parts.index attribute to be set")
+	}
+}
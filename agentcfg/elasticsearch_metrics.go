@@ -0,0 +1,154 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+)
+
+// fetcherMetrics groups the OTel instruments recorded by ElasticsearchFetcher.
+type fetcherMetrics struct {
+	refreshDuration          metric.Float64Histogram
+	hitsPerRefresh           metric.Int64Histogram
+	scrollPages              metric.Int64Counter
+	refreshFailures4xx       metric.Int64Counter
+	refreshFailures5xx       metric.Int64Counter
+	refreshFailuresTransport metric.Int64Counter
+	cacheSize                metric.Int64Histogram
+	cacheAge                 metric.Float64ObservableGauge
+	fetchHits                metric.Int64Counter
+	fetchMisses              metric.Int64Counter
+	fetchLatency             metric.Float64Histogram
+	eventsEmitted            metric.Int64Counter
+	eventsDropped            metric.Int64Counter
+	subscriberCount          metric.Int64UpDownCounter
+}
+
+func newFetcherMetrics(meter metric.Meter, f *ElasticsearchFetcher) (*fetcherMetrics, error) {
+	var m fetcherMetrics
+	var err error
+
+	if m.refreshDuration, err = meter.Float64Histogram(
+		"agentcfg.elasticsearch.refresh.duration",
+		metric.WithDescription("Duration of Elasticsearch agent config cache refreshes"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	if m.hitsPerRefresh, err = meter.Int64Histogram(
+		"agentcfg.elasticsearch.refresh.hits",
+		metric.WithDescription("Number of agent config documents retrieved per cache refresh"),
+	); err != nil {
+		return nil, err
+	}
+	if m.scrollPages, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.refresh.scroll_pages",
+		metric.WithDescription("Number of result pages (point-in-time or scroll) fetched while refreshing the cache"),
+	); err != nil {
+		return nil, err
+	}
+	if m.refreshFailures4xx, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.refresh.failures.4xx",
+		metric.WithDescription("Number of cache refreshes that failed with a 4xx response"),
+	); err != nil {
+		return nil, err
+	}
+	if m.refreshFailures5xx, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.refresh.failures.5xx",
+		metric.WithDescription("Number of cache refreshes that failed with a 5xx response"),
+	); err != nil {
+		return nil, err
+	}
+	if m.refreshFailuresTransport, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.refresh.failures.transport",
+		metric.WithDescription("Number of cache refreshes that failed before receiving a response"),
+	); err != nil {
+		return nil, err
+	}
+	if m.cacheSize, err = meter.Int64Histogram(
+		"agentcfg.elasticsearch.cache.size",
+		metric.WithDescription("Number of agent config documents held in the cache"),
+	); err != nil {
+		return nil, err
+	}
+	if m.cacheAge, err = meter.Float64ObservableGauge(
+		"agentcfg.elasticsearch.cache.age",
+		metric.WithDescription("Time elapsed since the cache was last refreshed successfully"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	if m.fetchHits, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.fetch.hits",
+		metric.WithDescription("Number of Fetch calls that returned without error, whether served from the cache or a fallback fetcher"),
+	); err != nil {
+		return nil, err
+	}
+	if m.fetchMisses, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.fetch.misses",
+		metric.WithDescription("Number of Fetch calls that returned an error, e.g. because the cache is not yet initialized and no fallback succeeded"),
+	); err != nil {
+		return nil, err
+	}
+	if m.fetchLatency, err = meter.Float64Histogram(
+		"agentcfg.elasticsearch.fetch.latency",
+		metric.WithDescription("Latency of Fetch calls"),
+		metric.WithUnit("s"),
+	); err != nil {
+		return nil, err
+	}
+	if m.eventsEmitted, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.subscriber.events_emitted",
+		metric.WithDescription("Number of config change events delivered to subscribers"),
+	); err != nil {
+		return nil, err
+	}
+	if m.eventsDropped, err = meter.Int64Counter(
+		"agentcfg.elasticsearch.subscriber.events_dropped",
+		metric.WithDescription("Number of config change events dropped because a subscriber's buffer was full"),
+	); err != nil {
+		return nil, err
+	}
+	if m.subscriberCount, err = meter.Int64UpDownCounter(
+		"agentcfg.elasticsearch.subscriber.count",
+		metric.WithDescription("Number of active ConfigChangeEvent subscribers"),
+	); err != nil {
+		return nil, err
+	}
+
+	// cacheAge is observed at collection time rather than recorded
+	// synchronously, since a refresh only happens periodically and a
+	// histogram recorded immediately after one would always read ~0.
+	if _, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		if !f.cacheInitialized.Load() {
+			return nil
+		}
+		f.mu.RLock()
+		last := f.last
+		f.mu.RUnlock()
+		o.ObserveFloat64(m.cacheAge, time.Since(last).Seconds())
+		return nil
+	}, m.cacheAge); err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
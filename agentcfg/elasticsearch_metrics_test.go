@@ -0,0 +1,86 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// findCacheAgeValue locates the cache.age data point recorded in rm, failing the
+// test if the metric wasn't exported.
+func findCacheAgeValue(t *testing.T, rm *metricdata.ResourceMetrics) float64 {
+	t.Helper()
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "agentcfg.elasticsearch.cache.age" {
+				continue
+			}
+			gauge, ok := m.Data.(metricdata.Gauge[float64])
+			if !ok || len(gauge.DataPoints) == 0 {
+				t.Fatalf("cache.age metric has no data points")
+			}
+			return gauge.DataPoints[0].Value
+		}
+	}
+	t.Fatal("cache.age metric not found")
+	return 0
+}
+
+func TestFetcherMetricsCacheAgeReflectsElapsedTime(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	f := &ElasticsearchFetcher{}
+	if _, err := newFetcherMetrics(mp.Meter(instrumentationName), f); err != nil {
+		t.Fatalf("newFetcherMetrics: %v", err)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "agentcfg.elasticsearch.cache.age" {
+				if gauge, ok := m.Data.(metricdata.Gauge[float64]); ok && len(gauge.DataPoints) > 0 {
+					t.Fatal("expected no cache.age data point before the cache is initialized")
+				}
+			}
+		}
+	}
+
+	f.mu.Lock()
+	f.last = time.Now().Add(-5 * time.Second)
+	f.mu.Unlock()
+	f.cacheInitialized.Store(true)
+
+	rm = metricdata.ResourceMetrics{}
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	age := findCacheAgeValue(t, &rm)
+	if age < 4 || age > 10 {
+		t.Errorf("cache.age = %v, want roughly 5 seconds", age)
+	}
+}
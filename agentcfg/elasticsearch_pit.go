@@ -0,0 +1,233 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// errPITUnsupported is returned internally when Elasticsearch rejects an
+// open point-in-time request, e.g. because the cluster predates 7.10 or its
+// license doesn't include the feature.
+var errPITUnsupported = errors.New("point-in-time search not supported by this cluster")
+
+// refreshCachePIT pages through the agent config index using a
+// point-in-time and search_after, which avoids the per-page "keep scroll
+// context alive" cost of the legacy scroll API.
+func (f *ElasticsearchFetcher) refreshCachePIT(ctx context.Context) ([]cachedDoc, int, error) {
+	pitID, err := f.openPIT(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.closePIT(ctx, pitID)
+
+	buffer := make([]cachedDoc, 0, len(f.cache))
+	var searchAfter []json.RawMessage
+
+	pages := 0
+	for {
+		result, err := f.singlePageRefreshPIT(ctx, pitID, searchAfter)
+		if err != nil {
+			return nil, 0, err
+		}
+		pages++
+
+		if result.PitID != "" {
+			pitID = result.PitID
+		}
+		for _, hit := range result.Hits.Hits {
+			buffer = append(buffer, cachedDocFromHit(hit))
+		}
+		if len(result.Hits.Hits) == 0 {
+			break
+		}
+		searchAfter = result.Hits.Hits[len(result.Hits.Hits)-1].Sort
+	}
+
+	return buffer, pages, nil
+}
+
+func (f *ElasticsearchFetcher) openPIT(ctx context.Context) (string, error) {
+	ctx, span := f.tracer.Start(ctx, "agentcfg.open_pit", trace.WithAttributes(
+		attribute.String("db.elasticsearch.index", f.indexName),
+	))
+	defer span.End()
+
+	resp, err := esapi.OpenPointInTimeRequest{
+		Index:     []string{f.indexName},
+		KeepAlive: f.keepAlive,
+	}.Do(ctx, f.client)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		span.SetStatus(codes.Error, errPITUnsupported.Error())
+		return "", errPITUnsupported
+	}
+	if resp.IsError() {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		f.logger.Debug(fmt.Sprintf("open point-in-time elasticsearch returned status %d: %s", resp.StatusCode, string(bodyBytes)))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			f.invalidESCfg.Store(true)
+		}
+		statusErr := &elasticsearchStatusError{StatusCode: resp.StatusCode}
+		span.RecordError(statusErr)
+		span.SetStatus(codes.Error, statusErr.Error())
+		return "", statusErr
+	}
+
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		span.RecordError(err)
+		return "", err
+	}
+	return result.ID, nil
+}
+
+func (f *ElasticsearchFetcher) closePIT(ctx context.Context, pitID string) {
+	if pitID == "" {
+		return
+	}
+
+	ctx, span := f.tracer.Start(ctx, "agentcfg.close_pit")
+	defer span.End()
+
+	body, err := json.Marshal(map[string]string{"id": pitID})
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+
+	resp, err := esapi.ClosePointInTimeRequest{Body: bytes.NewReader(body)}.Do(ctx, f.client)
+	if err != nil {
+		span.RecordError(err)
+		f.logger.Warn(fmt.Sprintf("failed to close point-in-time: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.IsError() {
+		f.logger.Warn(fmt.Sprintf("close point-in-time request returned error: %s", resp.Status()))
+	}
+}
+
+// pitSearchBody is the request body for a _search call scoped to an open
+// point-in-time, as opposed to an index named in the URL.
+type pitSearchBody struct {
+	Size        int               `json:"size"`
+	PIT         pitQuery          `json:"pit"`
+	Sort        []json.RawMessage `json:"sort"`
+	SearchAfter []json.RawMessage `json:"search_after,omitempty"`
+}
+
+type pitQuery struct {
+	ID        string `json:"id"`
+	KeepAlive string `json:"keep_alive"`
+}
+
+// pitSort orders hits by _shard_doc, the cheapest stable tie-breaker for
+// search_after pagination recommended by Elasticsearch for PIT searches.
+var pitSort = []json.RawMessage{json.RawMessage(`{"_shard_doc":"asc"}`)}
+
+// seqNoPrimaryTerm is passed to every PIT search so Elasticsearch includes
+// _seq_no and _primary_term on each hit; without it, cacheHit.SeqNo and
+// PrimaryTerm are always zero, which breaks both update detection in
+// reconcile and the _seq_no watermark used to page incremental refreshes.
+var seqNoPrimaryTerm = true
+
+func (f *ElasticsearchFetcher) singlePageRefreshPIT(ctx context.Context, pitID string, searchAfter []json.RawMessage) (cacheResult, error) {
+	ctx, span := f.tracer.Start(ctx, "agentcfg.single_page_refresh_pit", trace.WithAttributes(
+		attribute.Bool("agentcfg.has_search_after", len(searchAfter) > 0),
+	))
+	defer span.End()
+
+	var result cacheResult
+
+	payload, err := json.Marshal(pitSearchBody{
+		Size:        f.searchSize,
+		PIT:         pitQuery{ID: pitID, KeepAlive: formatESDuration(f.keepAlive)},
+		Sort:        pitSort,
+		SearchAfter: searchAfter,
+	})
+	if err != nil {
+		span.RecordError(err)
+		return result, err
+	}
+
+	resp, err := esapi.SearchRequest{
+		Body:             bytes.NewReader(payload),
+		SeqNoPrimaryTerm: &seqNoPrimaryTerm,
+	}.Do(ctx, f.client)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		// Elasticsearch returns 401 on unauthorized requests and 403 on insufficient permission
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			f.invalidESCfg.Store(true)
+		}
+		bodyBytes, err := io.ReadAll(resp.Body)
+		if err == nil {
+			f.logger.Debug(fmt.Sprintf("refresh cache elasticsearch returned status %d: %s", resp.StatusCode, string(bodyBytes)))
+		}
+		statusErr := &elasticsearchStatusError{StatusCode: resp.StatusCode}
+		span.RecordError(statusErr)
+		span.SetStatus(codes.Error, statusErr.Error())
+		return result, statusErr
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	span.SetAttributes(attribute.Int("agentcfg.hit_count", len(result.Hits.Hits)))
+	return result, err
+}
+
+// formatESDuration renders a time.Duration as an Elasticsearch duration
+// string (e.g. "60000ms"), for use in request bodies where esapi doesn't
+// already do the conversion for us.
+func formatESDuration(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+}
@@ -0,0 +1,120 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+func newTestESFetcher(t *testing.T, handler http.HandlerFunc) *ElasticsearchFetcher {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatalf("elasticsearch.NewClient: %v", err)
+	}
+	return NewElasticsearchFetcher(client, 0, zap.NewNop())
+}
+
+// TestRefreshCachePITPaginates proves refreshCachePIT follows search_after
+// across pages until Elasticsearch returns an empty page.
+func TestRefreshCachePITPaginates(t *testing.T) {
+	page := 0
+	f := newTestESFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "_pit"):
+			fmt.Fprint(w, `{"id":"pit-1"}`)
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "_pit"):
+			fmt.Fprint(w, `{"succeeded":true}`)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "_search"):
+			page++
+			switch page {
+			case 1:
+				fmt.Fprint(w, `{"pit_id":"pit-1","hits":{"hits":[
+					{"_id":"1","_seq_no":1,"_primary_term":1,"_source":{"agent_name":"a","settings":{}},"sort":["1"]}
+				]}}`)
+			default:
+				fmt.Fprint(w, `{"pit_id":"pit-1","hits":{"hits":[]}}`)
+			}
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	docs, pages, err := f.refreshCachePIT(context.Background())
+	if err != nil {
+		t.Fatalf("refreshCachePIT: %v", err)
+	}
+	if pages != 2 {
+		t.Errorf("pages = %d, want 2 (one page of hits, one empty page to stop)", pages)
+	}
+	if len(docs) != 1 || docs[0].id != "1" || docs[0].seqNo != 1 {
+		t.Fatalf("unexpected docs: %+v", docs)
+	}
+}
+
+// TestRefreshCacheScrollFallback proves the scroll pagination used as a
+// fallback for clusters that reject point-in-time search pages correctly.
+func TestRefreshCacheScrollFallback(t *testing.T) {
+	scrollPage := 0
+	f := newTestESFetcher(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "_pit"):
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"type":"illegal_argument_exception"}}`)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/_search/scroll"):
+			scrollPage++
+			fmt.Fprint(w, `{"_scroll_id":"scroll-1","hits":{"hits":[]}}`)
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/_search/scroll"):
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "_search"):
+			fmt.Fprint(w, `{"_scroll_id":"scroll-1","hits":{"hits":[
+				{"_id":"1","_seq_no":3,"_primary_term":1,"_source":{"agent_name":"a","settings":{}},"sort":["1"]}
+			]}}`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	docs, pages, err := f.refreshCacheScroll(context.Background())
+	if err != nil {
+		t.Fatalf("refreshCacheScroll: %v", err)
+	}
+	if pages != 2 {
+		t.Errorf("pages = %d, want 2 (one page of hits, one empty page to stop)", pages)
+	}
+	if len(docs) != 1 || docs[0].id != "1" {
+		t.Fatalf("unexpected docs: %+v", docs)
+	}
+	if scrollPage != 1 {
+		t.Errorf("expected exactly one /_search/scroll call, got %d", scrollPage)
+	}
+}
@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"errors"
+)
+
+// Fetcher finds a matching agent config for a query. ElasticsearchFetcher
+// and HTTPFetcher both implement it, and a ChainFetcher can combine any
+// number of Fetchers with deterministic precedence.
+type Fetcher interface {
+	Fetch(ctx context.Context, query Query) (Result, error)
+}
+
+var (
+	_ Fetcher = (*ElasticsearchFetcher)(nil)
+	_ Fetcher = (*HTTPFetcher)(nil)
+	_ Fetcher = (*ChainFetcher)(nil)
+)
+
+// ChainFetcher tries each of its Fetchers in order, returning the first
+// successful result. It's used to fall back from the primary Elasticsearch
+// fetcher to a remote config source while the local cache isn't ready.
+type ChainFetcher struct {
+	fetchers []Fetcher
+}
+
+// NewChainFetcher returns a ChainFetcher that queries fetchers in the given
+// order, stopping at the first one that succeeds.
+func NewChainFetcher(fetchers ...Fetcher) *ChainFetcher {
+	return &ChainFetcher{fetchers: fetchers}
+}
+
+// Fetch queries each underlying fetcher in order and returns the first
+// successful result. If every fetcher fails, the error from the last one
+// is returned.
+func (c *ChainFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	if len(c.fetchers) == 0 {
+		return Result{}, errors.New(ErrInfrastructureNotReady)
+	}
+
+	var lastErr error
+	for _, fetcher := range c.fetchers {
+		result, err := fetcher.Fetch(ctx, query)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+	}
+	return Result{}, lastErr
+}
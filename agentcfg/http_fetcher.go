@@ -0,0 +1,285 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HTTPFetcherConfig configures an HTTPFetcher.
+type HTTPFetcherConfig struct {
+	// ServerURL is the base URL of an APM-Server-compatible remote config
+	// source, e.g. "https://apm-server.example.com".
+	ServerURL string
+	// APIKey, if set, is sent as "Authorization: ApiKey <APIKey>".
+	APIKey string
+	// BearerToken, if set, is sent as "Authorization: Bearer <BearerToken>".
+	// APIKey takes precedence if both are set.
+	BearerToken string
+	// Timeout bounds each HTTP attempt; every retry gets its own Timeout.
+	// Defaults to 5 seconds.
+	Timeout time.Duration
+	// CacheTTL is how long a successful response is served from the
+	// in-memory cache before it's revalidated. Defaults to 30 seconds.
+	CacheTTL time.Duration
+	// MaxRetries bounds the number of retries on transport errors and 5xx
+	// responses. Defaults to 2.
+	MaxRetries int
+}
+
+func (c *HTTPFetcherConfig) withDefaults() HTTPFetcherConfig {
+	cfg := *c
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = 30 * time.Second
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 2
+	}
+	return cfg
+}
+
+// HTTPFetcher fetches agent config from an APM-Server-compatible
+// "/config/v1/agents" endpoint. It's used as a fallback Fetcher for
+// cold-start and invalid-Elasticsearch-config states, where
+// ElasticsearchFetcher has nothing useful to serve from its local cache.
+type HTTPFetcher struct {
+	cfg    HTTPFetcherConfig
+	client *http.Client
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	cache map[httpCacheKey]httpCacheEntry
+}
+
+type httpCacheKey struct {
+	serviceName        string
+	serviceEnvironment string
+	agentName          string
+}
+
+type httpCacheEntry struct {
+	result    Result
+	etag      string
+	expiresAt time.Time
+}
+
+// NewHTTPFetcher returns an HTTPFetcher for the given config.
+func NewHTTPFetcher(cfg HTTPFetcherConfig, logger *zap.Logger) *HTTPFetcher {
+	cfg = cfg.withDefaults()
+	return &HTTPFetcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		logger: logger,
+		cache:  make(map[httpCacheKey]httpCacheEntry),
+	}
+}
+
+// Fetch queries the remote config endpoint for a matching agent config,
+// serving from the TTL cache when possible and issuing a conditional GET
+// (If-None-Match) otherwise so unchanged config is cheap to re-fetch.
+func (h *HTTPFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	key := httpCacheKey{
+		serviceName:        query.ServiceName,
+		serviceEnvironment: query.ServiceEnvironment,
+		agentName:          query.AgentName,
+	}
+
+	h.mu.Lock()
+	entry, ok := h.cache[key]
+	h.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.result, nil
+	}
+
+	result, etag, notModified, err := h.fetchWithRetry(ctx, query, entry.etag)
+	if err != nil {
+		if ok {
+			// Serve the stale cached value rather than fail outright; the
+			// endpoint may be temporarily unreachable.
+			h.logger.Warn(fmt.Sprintf("http config fetch failed, serving stale cache entry: %s", err))
+			return entry.result, nil
+		}
+		return Result{}, err
+	}
+
+	if notModified {
+		// 304 Not Modified: refresh the TTL on the existing entry.
+		etag = entry.etag
+		result = entry.result
+	}
+
+	h.mu.Lock()
+	h.cache[key] = httpCacheEntry{
+		result:    result,
+		etag:      etag,
+		expiresAt: time.Now().Add(h.cfg.CacheTTL),
+	}
+	h.mu.Unlock()
+
+	return result, nil
+}
+
+// fetchWithRetry issues the HTTP request, retrying on transport errors and
+// 5xx responses, honoring any Retry-After header the server sends. A true
+// notModified return indicates a 304 Not Modified; etag is only meaningful
+// when notModified is false, since APM-Server doesn't always send one.
+func (h *HTTPFetcher) fetchWithRetry(ctx context.Context, query Query, knownEtag string) (result Result, etag string, notModified bool, err error) {
+	var lastErr error
+	for attempt := 0; attempt <= h.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return Result{}, "", false, ctx.Err()
+			case <-time.After(backoff(attempt)):
+			}
+		}
+
+		result, etag, notModified, retryAfter, err := h.doFetch(ctx, query, knownEtag)
+		if err == nil {
+			return result, etag, notModified, nil
+		}
+		lastErr = err
+		var clientErr *httpClientStatusError
+		if errors.As(err, &clientErr) {
+			return Result{}, "", false, err
+		}
+		if retryAfter > 0 {
+			select {
+			case <-ctx.Done():
+				return Result{}, "", false, ctx.Err()
+			case <-time.After(retryAfter):
+			}
+		}
+	}
+	return Result{}, "", false, lastErr
+}
+
+// doFetch performs a single HTTP round trip. A non-zero retryAfter means the
+// caller should wait before retrying, even on the final attempt's error. A
+// true notModified return indicates a 304, which is distinct from a 200
+// response with no Etag header (ETags are optional on APM-Server responses).
+func (h *HTTPFetcher) doFetch(ctx context.Context, query Query, knownEtag string) (result Result, etag string, notModified bool, retryAfter time.Duration, err error) {
+	reqURL, err := h.buildURL(query)
+	if err != nil {
+		return Result{}, "", false, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return Result{}, "", false, 0, err
+	}
+	h.setAuth(req)
+	if knownEtag != "" {
+		req.Header.Set("If-None-Match", knownEtag)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return Result{}, "", false, 0, err
+	}
+	defer resp.Body.Close()
+
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		if seconds, convErr := strconv.Atoi(ra); convErr == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return Result{}, "", true, 0, nil
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return Result{}, "", false, retryAfter, fmt.Errorf("http config fetch returned status %d", resp.StatusCode)
+	case resp.StatusCode >= http.StatusBadRequest:
+		// Client errors (auth, bad query) aren't worth retrying.
+		return Result{}, "", false, 0, &httpClientStatusError{statusCode: resp.StatusCode}
+	}
+
+	var body struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return Result{}, "", false, 0, err
+	}
+
+	etag = resp.Header.Get("Etag")
+	return Result{
+		Source: Source{
+			Settings:  body.Settings,
+			Etag:      etag,
+			AgentName: query.AgentName,
+		},
+	}, etag, false, 0, nil
+}
+
+// httpClientStatusError is a 4xx response, which fetchWithRetry doesn't retry.
+type httpClientStatusError struct {
+	statusCode int
+}
+
+func (e *httpClientStatusError) Error() string {
+	return fmt.Sprintf("http config fetch returned status %d", e.statusCode)
+}
+
+func (h *HTTPFetcher) buildURL(query Query) (string, error) {
+	u, err := url.Parse(h.cfg.ServerURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = "/config/v1/agents"
+
+	q := u.Query()
+	q.Set("service.name", query.ServiceName)
+	if query.ServiceEnvironment != "" {
+		q.Set("service.environment", query.ServiceEnvironment)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (h *HTTPFetcher) setAuth(req *http.Request) {
+	switch {
+	case h.cfg.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+h.cfg.APIKey)
+	case h.cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+h.cfg.BearerToken)
+	}
+}
+
+// backoff returns an exponential backoff delay for the given attempt number,
+// capped at 5 seconds.
+func backoff(attempt int) time.Duration {
+	d := time.Duration(1<<uint(attempt)) * 100 * time.Millisecond
+	if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	return d
+}
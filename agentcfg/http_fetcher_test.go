@@ -0,0 +1,138 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func testQuery() Query {
+	return Query{ServiceName: "service-a"}
+}
+
+// TestHTTPFetcherMissingEtagIsNotTreatedAs304 proves a fresh 200 response
+// with no Etag header (ETags are optional on APM-Server) is served as-is,
+// rather than being confused for a 304 and discarded in favor of a stale
+// cached entry.
+func TestHTTPFetcherMissingEtagIsNotTreatedAs304(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		if n == 1 {
+			w.Write([]byte(`{"settings":{"transaction_sample_rate":"0.1"}}`))
+			return
+		}
+		// Second call: no Etag on this response either; it must still be
+		// treated as fresh content, not a 304.
+		w.Write([]byte(`{"settings":{"transaction_sample_rate":"0.2"}}`))
+	}))
+	defer srv.Close()
+
+	f := NewHTTPFetcher(HTTPFetcherConfig{ServerURL: srv.URL, CacheTTL: time.Nanosecond}, zap.NewNop())
+
+	first, err := f.Fetch(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+	if first.Source.Settings["transaction_sample_rate"] != "0.1" {
+		t.Fatalf("unexpected first result: %+v", first)
+	}
+
+	time.Sleep(time.Millisecond)
+	second, err := f.Fetch(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("second fetch: %v", err)
+	}
+	if second.Source.Settings["transaction_sample_rate"] != "0.2" {
+		t.Fatalf("second fetch returned stale cached value instead of the fresh response: %+v", second)
+	}
+}
+
+// TestHTTPFetcherReal304ServesCachedValue proves an actual 304 Not Modified
+// still reuses the cached entry.
+func TestHTTPFetcherReal304ServesCachedValue(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			w.Header().Set("Etag", `"v1"`)
+			w.Write([]byte(`{"settings":{"transaction_sample_rate":"0.1"}}`))
+			return
+		}
+		if r.Header.Get("If-None-Match") != `"v1"` {
+			t.Errorf("expected If-None-Match on revalidation, got %q", r.Header.Get("If-None-Match"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	f := NewHTTPFetcher(HTTPFetcherConfig{ServerURL: srv.URL, CacheTTL: time.Nanosecond}, zap.NewNop())
+
+	first, err := f.Fetch(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+
+	time.Sleep(time.Millisecond)
+	second, err := f.Fetch(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("second fetch: %v", err)
+	}
+	if second.Source.Settings["transaction_sample_rate"] != first.Source.Settings["transaction_sample_rate"] {
+		t.Errorf("304 response should have served the cached value, got %+v", second)
+	}
+}
+
+// TestHTTPFetcherServesStaleOnError proves a failing endpoint (5xx) serves
+// the last good cached result rather than failing outright.
+func TestHTTPFetcherServesStaleOnError(t *testing.T) {
+	up := int32(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"settings":{"transaction_sample_rate":"0.1"}}`))
+	}))
+	defer srv.Close()
+
+	f := NewHTTPFetcher(HTTPFetcherConfig{ServerURL: srv.URL, CacheTTL: time.Nanosecond, MaxRetries: 0}, zap.NewNop())
+
+	first, err := f.Fetch(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+
+	atomic.StoreInt32(&up, 0)
+	time.Sleep(time.Millisecond)
+	second, err := f.Fetch(context.Background(), testQuery())
+	if err != nil {
+		t.Fatalf("expected stale cache to be served without error, got: %v", err)
+	}
+	if second.Source.Settings["transaction_sample_rate"] != first.Source.Settings["transaction_sample_rate"] {
+		t.Errorf("expected stale cached value, got %+v", second)
+	}
+}
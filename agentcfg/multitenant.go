@@ -0,0 +1,235 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// TenantResolver derives a tenant id from an incoming Query, e.g. from a
+// label or resource attribute carried alongside it.
+type TenantResolver func(query Query) (string, error)
+
+// TenantConfig configures a single tenant's ElasticsearchFetcher within a
+// MultiTenantFetcher.
+type TenantConfig struct {
+	// Client is the Elasticsearch client for this tenant's cluster.
+	Client *elasticsearch.Client
+	// IndexName overrides ElasticsearchIndexName for this tenant, if set.
+	IndexName string
+	// CacheDuration is this tenant's cache refresh cadence.
+	CacheDuration time.Duration
+	// Options are additional ElasticsearchFetcher options, e.g.
+	// WithTracerProvider or WithFallbackFetcher.
+	Options []Option
+}
+
+// TenantStatus reports the health of a single tenant's fetcher.
+type TenantStatus struct {
+	LastRefresh time.Time
+	LastError   error
+	CacheSize   int
+	Degraded    bool
+}
+
+type tenantEntry struct {
+	fetcher *ElasticsearchFetcher
+	period  time.Duration
+
+	mu     sync.RWMutex
+	status TenantStatus
+}
+
+// MultiTenantFetcher routes Fetch calls to one of several
+// ElasticsearchFetchers based on a TenantResolver, for collector
+// deployments fronting multiple Elastic tenants/clusters. Each tenant
+// refreshes its cache on its own cadence, jittered so tenants sharing a
+// cache duration don't all hit their clusters at once. A tenant whose
+// Elasticsearch config becomes invalid is marked degraded in Status()
+// without affecting the others.
+type MultiTenantFetcher struct {
+	resolver TenantResolver
+	logger   *zap.Logger
+
+	mu      sync.RWMutex
+	tenants map[string]*tenantEntry
+}
+
+var _ Fetcher = (*MultiTenantFetcher)(nil)
+
+// NewMultiTenantFetcher returns an empty MultiTenantFetcher. Call AddTenant
+// to register tenants before Run.
+func NewMultiTenantFetcher(resolver TenantResolver, logger *zap.Logger) *MultiTenantFetcher {
+	return &MultiTenantFetcher{
+		resolver: resolver,
+		logger:   logger,
+		tenants:  make(map[string]*tenantEntry),
+	}
+}
+
+// defaultTenantCacheDuration is used for a tenant whose CacheDuration isn't
+// set, since a zero period would make runTenant's jitter and ticker panic.
+const defaultTenantCacheDuration = 30 * time.Second
+
+// AddTenant registers a tenant's Elasticsearch fetcher. It must be called
+// before Run to have the tenant's cache refreshed in the background; Fetch
+// will otherwise return an error for that tenant's queries.
+func (m *MultiTenantFetcher) AddTenant(id string, cfg TenantConfig) {
+	period := cfg.CacheDuration
+	if period <= 0 {
+		period = defaultTenantCacheDuration
+	}
+
+	opts := cfg.Options
+	if cfg.IndexName != "" {
+		opts = append(opts, WithIndexName(cfg.IndexName))
+	}
+	fetcher := NewElasticsearchFetcher(cfg.Client, period, m.logger.With(zap.String("tenant", id)), opts...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tenants[id] = &tenantEntry{fetcher: fetcher, period: period}
+}
+
+// RemoveTenant unregisters a tenant. Its background refresh loop, if
+// running, exits the next time it wakes: either on its next tick, or once
+// its initial jitter elapses if it's still waiting that out.
+func (m *MultiTenantFetcher) RemoveTenant(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tenants, id)
+}
+
+// stillRegistered reports whether id is still present in m.tenants, so
+// runTenant can stop refreshing a tenant that's been removed.
+func (m *MultiTenantFetcher) stillRegistered(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.tenants[id]
+	return ok
+}
+
+// Fetch resolves query to a tenant via the configured TenantResolver and
+// delegates to that tenant's fetcher.
+func (m *MultiTenantFetcher) Fetch(ctx context.Context, query Query) (Result, error) {
+	tenantID, err := m.resolver(query)
+	if err != nil {
+		return Result{}, fmt.Errorf("agentcfg: resolve tenant: %w", err)
+	}
+
+	m.mu.RLock()
+	entry, ok := m.tenants[tenantID]
+	m.mu.RUnlock()
+	if !ok {
+		return Result{}, fmt.Errorf("agentcfg: unknown tenant %q", tenantID)
+	}
+
+	return entry.fetcher.Fetch(ctx, query)
+}
+
+// Run refreshes every registered tenant's cache on its own cadence until ctx
+// is done. Each tenant runs in its own goroutine from a shared pool, so a
+// stuck or slow tenant can't block the others.
+func (m *MultiTenantFetcher) Run(ctx context.Context) error {
+	m.mu.RLock()
+	entries := make(map[string]*tenantEntry, len(m.tenants))
+	for id, entry := range m.tenants {
+		entries[id] = entry
+	}
+	m.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for id, entry := range entries {
+		wg.Add(1)
+		go func(id string, entry *tenantEntry) {
+			defer wg.Done()
+			m.runTenant(ctx, id, entry)
+		}(id, entry)
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// runTenant is the per-tenant refresh loop. It waits out a random jitter
+// before the first tick so tenants sharing a cache duration don't all
+// refresh in lockstep, then refreshes on entry.period thereafter.
+func (m *MultiTenantFetcher) runTenant(ctx context.Context, id string, entry *tenantEntry) {
+	jitter := time.Duration(rand.Int63n(int64(entry.period)))
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(jitter):
+	}
+	if !m.stillRegistered(id) {
+		return
+	}
+
+	refresh := func() {
+		err := entry.fetcher.refreshCache(ctx)
+		if err != nil {
+			m.logger.Warn(fmt.Sprintf("tenant %q refresh cache error: %s", id, err))
+		}
+
+		entry.mu.Lock()
+		entry.status = TenantStatus{
+			LastRefresh: time.Now(),
+			LastError:   err,
+			CacheSize:   entry.fetcher.CacheSize(),
+			Degraded:    err != nil || entry.fetcher.invalidESCfg.Load(),
+		}
+		entry.mu.Unlock()
+	}
+
+	refresh()
+	t := time.NewTicker(entry.period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !m.stillRegistered(id) {
+				return
+			}
+			refresh()
+		}
+	}
+}
+
+// Status returns the current health of every registered tenant.
+func (m *MultiTenantFetcher) Status() map[string]TenantStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	statuses := make(map[string]TenantStatus, len(m.tenants))
+	for id, entry := range m.tenants {
+		entry.mu.RLock()
+		statuses[id] = entry.status
+		entry.mu.RUnlock()
+	}
+	return statuses
+}
@@ -0,0 +1,155 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package agentcfg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+func newTestESClient(t *testing.T, handler http.HandlerFunc) *elasticsearch.Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatalf("elasticsearch.NewClient: %v", err)
+	}
+	return client
+}
+
+// TestAddTenantDefaultsZeroCacheDuration proves a tenant registered without
+// a CacheDuration gets a usable period instead of one that would panic
+// runTenant's jitter and ticker.
+func TestAddTenantDefaultsZeroCacheDuration(t *testing.T) {
+	client := newTestESClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	m := NewMultiTenantFetcher(func(Query) (string, error) { return "t1", nil }, zap.NewNop())
+	m.AddTenant("t1", TenantConfig{Client: client})
+
+	m.mu.RLock()
+	period := m.tenants["t1"].period
+	m.mu.RUnlock()
+
+	if period <= 0 {
+		t.Fatalf("tenant period = %v, want a positive default", period)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("runTenant panicked with a zero CacheDuration tenant: %v", r)
+		}
+	}()
+	m.runTenant(ctx, "t1", m.tenants["t1"])
+}
+
+// TestRemoveTenantStopsRefreshLoop proves a removed tenant's background
+// refresh loop exits instead of refreshing a deleted entry forever.
+func TestRemoveTenantStopsRefreshLoop(t *testing.T) {
+	var refreshes int32
+	client := newTestESClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&refreshes, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	m := NewMultiTenantFetcher(func(Query) (string, error) { return "t1", nil }, zap.NewNop())
+	m.AddTenant("t1", TenantConfig{Client: client, CacheDuration: 5 * time.Millisecond})
+
+	m.mu.RLock()
+	entry := m.tenants["t1"]
+	m.mu.RUnlock()
+
+	done := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go func() {
+		m.runTenant(ctx, "t1", entry)
+		close(done)
+	}()
+
+	// Let the initial refresh (and maybe one tick) happen, then remove the
+	// tenant and make sure the loop doesn't keep refreshing it.
+	time.Sleep(20 * time.Millisecond)
+	m.RemoveTenant("t1")
+	countAtRemoval := atomic.LoadInt32(&refreshes)
+
+	time.Sleep(60 * time.Millisecond)
+	countAfter := atomic.LoadInt32(&refreshes)
+	if countAfter > countAtRemoval+1 {
+		t.Errorf("refreshes kept increasing after RemoveTenant: %d at removal, %d after", countAtRemoval, countAfter)
+	}
+
+	<-done
+}
+
+// TestFetchRoutesToResolvedTenant proves Fetch delegates to the tenant
+// resolved from the query, and degraded tenants are reported in Status.
+func TestFetchRoutesToResolvedTenant(t *testing.T) {
+	client := newTestESClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":{"type":"security_exception"}}`)
+	})
+
+	m := NewMultiTenantFetcher(func(q Query) (string, error) {
+		if q.ServiceName == "" {
+			return "", fmt.Errorf("missing service name")
+		}
+		return "tenant-" + q.ServiceName, nil
+	}, zap.NewNop())
+	m.AddTenant("tenant-svc", TenantConfig{Client: client, CacheDuration: time.Second})
+
+	if _, err := m.Fetch(context.Background(), Query{ServiceName: "unknown"}); err == nil {
+		t.Error("expected an error routing to an unregistered tenant")
+	}
+
+	entry := m.tenants["tenant-svc"]
+	if err := entry.fetcher.refreshCache(context.Background()); err == nil {
+		t.Fatal("expected refreshCache against a 403 response to fail")
+	}
+	if !entry.fetcher.invalidESCfg.Load() {
+		t.Fatal("expected invalidESCfg to be set after a 403 response")
+	}
+	// "svc" resolves to tenant-svc, whose fetcher has no fallback and an
+	// uninitialized cache with invalid config.
+	if _, err := m.Fetch(context.Background(), Query{ServiceName: "svc"}); err == nil || err.Error() != ErrNoValidElasticsearchConfig {
+		t.Errorf("expected tenant-svc's fetcher to answer with %q, got %v", ErrNoValidElasticsearchConfig, err)
+	}
+
+	entry.mu.Lock()
+	entry.status = TenantStatus{Degraded: true}
+	entry.mu.Unlock()
+
+	statuses := m.Status()
+	if !statuses["tenant-svc"].Degraded {
+		t.Error("expected tenant-svc to be reported degraded")
+	}
+}